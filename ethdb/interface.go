@@ -31,6 +31,23 @@ type Deleter interface {
 	Delete(key []byte) error
 }
 
+// Getter wraps the database read operation shared by Database and Snapshot.
+type Getter interface {
+	Get(key []byte) ([]byte, error)
+}
+
+// Snapshot is a non-blocking, point-in-time consistent read view of a
+// Database, independent of concurrent writers: once obtained, it keeps
+// returning the data as it stood when the Snapshot was taken, regardless
+// of later Put/Delete calls on the Database it came from. Callers must
+// call Release when done to let the Database reclaim any resources (e.g.
+// frozen copy-on-write maps) the snapshot was pinning.
+type Snapshot interface {
+	Getter
+	Has(key []byte) (bool, error)
+	Release()
+}
+
 // Database wraps all database operations. All methods are safe for concurrent use.
 //数据库接口定义了所有的数据库操作， 所有的方法都是多线程安全的。
 type Database interface {
@@ -40,6 +57,8 @@ type Database interface {
 	Has(key []byte) (bool, error)
 	Close()
 	NewBatch() Batch
+	// Snapshot返回当前数据的一个非阻塞、时间点一致的只读视图，不受后续并发写入影响。
+	Snapshot() (Snapshot, error)
 }
 
 // Batch is a write-only database that commits changes to its host database
@@ -0,0 +1,342 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// flushLoop runs for the lifetime of the database, flushing queued
+// immutable memtables to L0 SSTables and triggering compaction whenever a
+// flush leaves L0 over its trigger count. It exits once Close is called
+// and every pending memtable has been flushed.
+// flushLoop在数据库的整个生命周期内运行，把排队等待的不可变memtable flush成
+// L0层的SSTable，并在flush之后L0超过触发阈值时启动compaction。只有Close被
+// 调用且所有待flush的memtable都处理完之后，这个循环才会退出。
+func (db *LSMDatabase) flushLoop() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.flushReq:
+			db.flushAll()
+		case <-db.closed:
+			db.flushAll()
+			return
+		}
+	}
+}
+
+// flushAll依次把db.imm队列里排队的每一个不可变memtable flush成L0的SSTable，
+// 直到队列清空为止。
+func (db *LSMDatabase) flushAll() {
+	for {
+		db.mu.Lock()
+		if len(db.imm) == 0 {
+			db.mu.Unlock()
+			return
+		}
+		oldest := db.imm[0] //总是flush最老的那一个，保持L0内的时间顺序
+		db.mu.Unlock()
+
+		entries := make([]sstableEntry, 0, oldest.mt.size)
+		oldest.mt.ascend(func(key string, value []byte, del bool) {
+			entries = append(entries, sstableEntry{key: key, value: value, del: del})
+		})
+
+		db.mu.Lock()
+		fileNum := db.nextFileNum
+		db.nextFileNum++
+		db.mu.Unlock()
+
+		path := sstablePath(db.dir, 0, fileNum)
+		if err := writeSSTable(path, entries); err != nil {
+			// Leave the memtable queued; a future flush attempt (or operator
+			// intervention) can retry once whatever caused the write to fail
+			// (e.g. a full disk) is resolved.
+			// 把memtable继续留在队列里；等导致写入失败的原因(比如磁盘满了)
+			// 解决之后，未来的flush尝试(或者运维人工介入)可以重试。
+			return
+		}
+		atomic.AddUint64(&db.stats.BytesWritten, sstableByteSize(entries))
+
+		table, err := loadSSTable(path, 0, fileNum)
+		if err != nil {
+			return
+		}
+
+		db.mu.Lock()
+		db.imm = db.imm[1:]
+		db.levels[0] = append(db.levels[0], table)
+		db.stats.FlushCount++
+		needsCompaction := len(db.levels[0]) >= lsmL0CompactionTrigger
+		db.mu.Unlock()
+
+		// oldest's data is now durable in an SSTable, so the WAL segment(s)
+		// it was writing through can finally be deleted instead of growing
+		// the log forever and being replayed again on every future Recover.
+		// oldest的数据现在已经durable地保存在SSTable里了，所以它当初写入的
+		// WAL分段文件终于可以删掉了，不然日志会无限增长，并且每次Recover都
+		// 要重放一遍。
+		for _, walPath := range oldest.walPaths {
+			os.Remove(walPath)
+		}
+
+		if needsCompaction {
+			db.compact()
+		}
+	}
+}
+
+// compact merges L0 into L1, then keeps cascading upward as long as the
+// level it just grew is over its byte budget: L0 is triggered by file
+// count (its files are allowed to overlap, so count is what bounds read
+// amplification there), while L1 and above are triggered by accumulated
+// table bytes compared against levelByteCapacity(lvl). A file-count check
+// on L1+ would never retrigger here, since every merge collapses the
+// target level down to exactly one file - "1 table < ratio" is always
+// true, so a byte budget is the only thing that can still cascade a
+// second, third, ... compaction once a level has grown past it.
+// compact把L0合并进L1，然后只要刚刚变大的那一层超过了它的字节预算，就继续
+// 往上级联合并：L0用文件数来触发(L0的文件允许key范围重叠，所以文件数才是
+// 限制它读放大的指标)，而L1及以上用累计的表字节数和levelByteCapacity(lvl)
+// 比较来触发。这里如果对L1+也用文件数判断就永远不会再次触发，因为每次合并
+// 都会把目标层收缩成恰好一个文件——"1个文件 < ratio"永远成立；只有按字节
+// 预算判断，一个层在超过预算之后才能继续触发第二次、第三次……合并。
+func (db *LSMDatabase) compact() {
+	for lvl := 0; lvl < lsmMaxLevels-1; lvl++ {
+		db.mu.Lock()
+		tables := db.levels[lvl]
+		var needsCompaction bool
+		if lvl == 0 {
+			needsCompaction = len(tables) >= lsmL0CompactionTrigger
+		} else {
+			needsCompaction = levelByteSize(tables) >= db.levelByteCapacity(lvl)
+		}
+		if !needsCompaction {
+			db.mu.Unlock()
+			break //这一层还没超过阈值，不需要继续往上合并
+		}
+		next := db.levels[lvl+1]
+		db.mu.Unlock()
+
+		merged, bytesRead := mergeTables(tables, next)
+		fileNum := db.allocFileNum()
+		path := sstablePath(db.dir, lvl+1, fileNum)
+		if err := writeSSTable(path, merged); err != nil {
+			return
+		}
+		newTable, err := loadSSTable(path, lvl+1, fileNum)
+		if err != nil {
+			return
+		}
+
+		db.mu.Lock()
+		db.levels[lvl] = nil
+		oldNext := db.levels[lvl+1]
+		db.levels[lvl+1] = []*sstable{newTable}
+		db.stats.CompactionCount++
+		db.mu.Unlock()
+
+		atomic.AddUint64(&db.stats.BytesRead, bytesRead)
+		atomic.AddUint64(&db.stats.BytesWritten, sstableByteSize(merged))
+
+		db.removeTables(tables)
+		db.removeTables(oldNext)
+	}
+}
+
+// levelByteCapacity returns the target byte budget for lvl (lvl >= 1): L1's
+// budget is the memtable size times LevelSizeRatio, and every level above
+// that multiplies by LevelSizeRatio again, giving the ~10x-per-level growth
+// leveled compaction relies on to bound write/read amplification.
+// levelByteCapacity返回lvl(lvl >= 1)这一层的目标字节预算：L1的预算是
+// memtable大小乘以LevelSizeRatio，再往上每一层都继续乘以LevelSizeRatio，
+// 这就是leveled compaction用来限制写/读放大的"每层约10倍"增长规律。
+func (db *LSMDatabase) levelByteCapacity(lvl int) uint64 {
+	capacity := uint64(db.opts.MemtableSize) * uint64(db.opts.LevelSizeRatio)
+	for i := 1; i < lvl; i++ {
+		capacity *= uint64(db.opts.LevelSizeRatio)
+	}
+	return capacity
+}
+
+// levelByteSize累加一个层里所有表的字节数，供和levelByteCapacity比较。
+func levelByteSize(tables []*sstable) uint64 {
+	var n uint64
+	for _, t := range tables {
+		n += sstableByteSize(t.entries)
+	}
+	return n
+}
+
+// allocFileNum分配下一个全局唯一递增的文件编号。
+func (db *LSMDatabase) allocFileNum() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := db.nextFileNum
+	db.nextFileNum++
+	return n
+}
+
+// removeTables unlinks each table's backing file unless it is currently
+// pinned by an open Snapshot, in which case removal is deferred until the
+// last referencing snapshot is released.
+// removeTables删除每个表对应的磁盘文件，除非它当前正被某个打开的Snapshot
+// 引用(pinned)——这种情况下删除会推迟到最后一个引用它的snapshot被Release。
+func (db *LSMDatabase) removeTables(tables []*sstable) {
+	for _, t := range tables {
+		db.mu.Lock()
+		if db.pinned[t.path] > 0 {
+			db.deleted[t.path] = true //标记为待删除，Release时真正删除
+			db.mu.Unlock()
+			continue
+		}
+		db.mu.Unlock()
+		os.Remove(t.path)
+	}
+}
+
+// mergeTables把tables和next两层的数据合并成一个有序序列，供写入下一层使用。
+func mergeTables(tables []*sstable, next []*sstable) (merged []sstableEntry, bytesRead uint64) {
+	var acc []sstableEntry
+	for _, t := range tables {
+		acc = mergeSorted(acc, t.entries)
+		bytesRead += sstableByteSize(t.entries)
+	}
+	for _, t := range next {
+		acc = mergeSorted(t.entries, acc)
+		bytesRead += sstableByteSize(t.entries)
+	}
+	return acc, bytesRead
+}
+
+// sstableByteSize估算一组entries占用的字节数，用于统计读写放大。
+func sstableByteSize(entries []sstableEntry) uint64 {
+	var n uint64
+	for _, e := range entries {
+		n += uint64(len(e.key) + len(e.value))
+	}
+	return n
+}
+
+// lsmSnapshot is a point-in-time consistent Database view over an
+// LSMDatabase, obtained by pinning the current set of SSTable files (so
+// background compaction defers deleting them) plus a copy of the memtable
+// chain in effect at Snapshot() time.
+//
+// Every memtable referenced here is, by construction, one Snapshot forced
+// into db.imm - never the live db.mem that Put/Delete keep mutating in
+// place. That is what makes reading it without db.mu safe: once a
+// memtable sits in db.imm nothing touches it again except ascend() during
+// flush, which only reads.
+// lsmSnapshot是LSMDatabase某一时刻一致的只读视图，通过pin住当时的SSTable
+// 文件集合(这样后台compaction会推迟删除它们)，再加上Snapshot()那一刻的
+// memtable链的一份拷贝得到。
+//
+// 这里引用到的每一个memtable，按构造方式来说，都是被Snapshot强制轮换进
+// db.imm的——绝不会是Put/Delete还在原地修改的那个活跃的db.mem。正因为
+// 如此，不持有db.mu去读它才是安全的：一个memtable一旦进了db.imm，除了
+// flush时只读的ascend()之外，不会再有任何东西去碰它。
+type lsmSnapshot struct {
+	db     *LSMDatabase
+	imm    []*memtable
+	tables [lsmMaxLevels][]*sstable
+	pinned []string
+}
+
+// Snapshot returns a consistent, non-blocking read view of the database as
+// of the time it was taken. It first force-rotates the active memtable
+// into the immutable queue (even if it hasn't hit its size budget yet) so
+// the snapshot only ever references frozen memtables that Put/Delete can
+// no longer mutate; concurrent writers keep going against a brand new
+// active memtable. The snapshot also pins the current SSTable files so
+// compaction defers deleting them until Release.
+// Snapshot返回数据库在这一时刻的一致性、不阻塞的只读视图。它首先强制把活跃
+// memtable轮换进不可变队列(即使还没达到容量上限)，这样snapshot引用到的
+// 永远是Put/Delete再也不会修改的冻结memtable；并发的写入方则继续写向一个
+// 全新的活跃memtable。Snapshot还会pin住当前的SSTable文件，让compaction
+// 推迟删除它们直到Release。
+func (db *LSMDatabase) Snapshot() (Snapshot, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.rotateMemtableLocked(); err != nil {
+		return nil, err
+	}
+
+	snap := &lsmSnapshot{db: db}
+	for _, e := range db.imm {
+		snap.imm = append(snap.imm, e.mt)
+	}
+	for lvl, tables := range db.levels {
+		snap.tables[lvl] = append([]*sstable(nil), tables...)
+		for _, t := range tables {
+			db.pinned[t.path]++
+			snap.pinned = append(snap.pinned, t.path)
+		}
+	}
+	return snap, nil
+}
+
+// Get依次查找：先是最新到最老的冻结memtable，再是每一层从新到旧的SSTable，
+// 第一个命中的就是答案，这和LSM的"新数据遮盖旧数据"语义一致。
+func (s *lsmSnapshot) Get(key []byte) ([]byte, error) {
+	for i := len(s.imm) - 1; i >= 0; i-- {
+		if e, ok := s.imm[i].get(string(key)); ok {
+			return resolveMemtableEntry(e)
+		}
+	}
+	for _, tables := range s.tables {
+		for i := len(tables) - 1; i >= 0; i-- {
+			if value, del, ok := tables[i].get(string(key)); ok {
+				if del {
+					return nil, errNotFound
+				}
+				return append([]byte(nil), value...), nil
+			}
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *lsmSnapshot) Has(key []byte) (bool, error) {
+	_, err := s.Get(key)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Release unpins this snapshot's SSTable files, unlinking any that were
+// deleted by a compaction while the snapshot was outstanding.
+// Release解除这个snapshot对它所用SSTable文件的pin，如果snapshot存续期间
+// 有文件已经被compaction标记删除，这里就真正把它们删掉。
+func (s *lsmSnapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	for _, path := range s.pinned {
+		s.db.pinned[path]--
+		if s.db.pinned[path] == 0 {
+			delete(s.db.pinned, path)
+			if s.db.deleted[path] {
+				delete(s.db.deleted, path)
+				os.Remove(path)
+			}
+		}
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var errNotFound = errors.New("not found")
+
+const (
+	// lsmDefaultMemtableSize is the default memtable size budget before it
+	// is rotated out and queued for flush to an SSTable.
+	// lsmDefaultMemtableSize是memtable在被轮换出去排队flush之前的默认容量上限。
+	lsmDefaultMemtableSize = 64 * 1024 * 1024
+	// lsmDefaultLevelSizeRatio is the target size ratio between adjacent
+	// levels above L0 (L1's byte budget is ~10x the memtable size, L2's is
+	// ~10x L1's, and so on).
+	// lsmDefaultLevelSizeRatio是L0以上相邻两层之间的目标大小比例(L1的字节预算
+	// 约是memtable大小的10倍，L2约是L1的10倍，以此类推)。
+	lsmDefaultLevelSizeRatio = 10
+	// lsmL0CompactionTrigger is how many L0 tables (which are allowed to
+	// overlap in key range, unlike L1+) accumulate before they are merged
+	// down into L1.
+	// lsmL0CompactionTrigger是L0层(和L1+不同，L0允许key范围重叠)累积到多少
+	// 个表之后就会被合并进L1。
+	lsmL0CompactionTrigger = 4
+	lsmMaxLevels           = 7 //总层数
+)
+
+// LSMOptions configures an LSMDatabase. A nil *LSMOptions passed to
+// NewLSMDatabase uses the defaults documented on the constants above.
+// LSMOptions用来配置一个LSMDatabase。传给NewLSMDatabase的*LSMOptions如果为
+// nil，就使用上面常量里写的默认值。
+type LSMOptions struct {
+	MemtableSize   int
+	FsyncOnCommit  bool //每次提交是否都fsync
+	LevelSizeRatio int
+}
+
+func (o *LSMOptions) withDefaults() LSMOptions {
+	if o == nil {
+		return LSMOptions{
+			MemtableSize:   lsmDefaultMemtableSize,
+			LevelSizeRatio: lsmDefaultLevelSizeRatio,
+		}
+	}
+	out := *o
+	if out.MemtableSize <= 0 {
+		out.MemtableSize = lsmDefaultMemtableSize
+	}
+	if out.LevelSizeRatio <= 0 {
+		out.LevelSizeRatio = lsmDefaultLevelSizeRatio
+	}
+	return out
+}
+
+// LSMStats exposes the write/read/space amplification counters tracked by
+// an LSMDatabase, for introspection by callers (e.g. metrics reporters).
+// LSMStats把LSMDatabase追踪的写放大/读放大/空间放大计数器暴露出来，供调用方
+// (比如指标上报组件)查看。
+type LSMStats struct {
+	FlushCount      uint64
+	CompactionCount uint64
+	BytesWritten    uint64 // total bytes written to SSTables, across flushes and compactions flush和compaction过程中累计写入SSTable的总字节数
+	BytesRead       uint64 // total bytes read back off SSTables while compacting or answering Get compaction或响应Get时累计从SSTable读回的总字节数
+	LiveSSTableSize uint64 // bytes currently live on disk across all levels 当前所有层加起来，磁盘上存活的数据总字节数
+}
+
+// immEntry is a memtable that has been retired from active writing and is
+// queued for flush, paired with the WAL segment file(s) whose records it
+// fully covers. Those segment files are only deleted once this memtable
+// has actually been flushed to an SSTable - never before - so a crash
+// before the flush completes still finds the data on replay.
+// immEntry是一个已经停止接受写入、排队等待flush的memtable，并且记录了它完整
+// 覆盖的WAL分段文件。这些分段文件只有在该memtable真正flush成SSTable之后才会
+// 被删除——绝不会提前删——这样即使在flush完成之前崩溃，重放时依然能找回数据。
+type immEntry struct {
+	mt       *memtable
+	walPaths []string
+}
+
+// LSMDatabase is an ethdb.Database backed by an in-process log-structured
+// merge tree: a skiplist memtable absorbs writes, a write-ahead log makes
+// every Put/Delete durable before it is applied, and background goroutines
+// flush full memtables to sorted, immutable on-disk SSTables and compact
+// them across levels. Unlike MemDatabase it survives a process restart via
+// Recover, and unlike shelling out to LevelDB it needs no cgo dependency.
+// LSMDatabase是一个进程内的、基于日志结构合并树(log-structured merge tree)
+// 实现的ethdb.Database：跳表memtable吸收写入，预写日志(WAL)在应用每次
+// Put/Delete之前先让它持久化，后台goroutine把写满的memtable flush成有序、
+// 不可变的磁盘SSTable并跨层compact。和MemDatabase不同，它能在进程重启后通过
+// Recover恢复；和直接调用LevelDB不同，它不需要cgo依赖。
+type LSMDatabase struct {
+	dir  string
+	opts LSMOptions
+
+	mu     sync.RWMutex
+	mem    *memtable //当前活跃、可写的memtable
+	imm    []immEntry
+	levels [lsmMaxLevels][]*sstable
+
+	nextFileNum uint64
+
+	pinned  map[string]int  // live snapshot refcounts by sstable path 按sstable路径统计的、当前存活snapshot的引用计数
+	deleted map[string]bool // paths whose files are unlinked once their refcount drops to zero 引用计数归零后才会真正unlink的文件路径集合
+
+	// wal is the segment backing the active memtable; walSegNum and
+	// walPath identify it so rotateMemtableLocked can record which
+	// segment(s) an outgoing memtable is responsible for.
+	// wal是当前活跃memtable对应的WAL分段；walSegNum和walPath用来标识它，
+	// 这样rotateMemtableLocked就能记录下被换出去的memtable对应哪个分段。
+	wal       *wal
+	walSegNum uint64
+	walPath   string
+
+	flushReq chan struct{}
+	closed   chan struct{}
+	wg       sync.WaitGroup
+
+	stats LSMStats
+}
+
+// NewLSMDatabase opens (creating if necessary) an LSMDatabase rooted at
+// dir, replaying its write-ahead log segments and discovering any existing
+// SSTables before accepting new writes.
+// NewLSMDatabase打开(必要时创建)一个以dir为根目录的LSMDatabase，在接受新的
+// 写入之前先重放它的WAL分段并发现已有的SSTable。
+func NewLSMDatabase(dir string, opts *LSMOptions) (*LSMDatabase, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db := &LSMDatabase{
+		dir:      dir,
+		opts:     opts.withDefaults(),
+		mem:      newMemtable(),
+		pinned:   make(map[string]int),
+		deleted:  make(map[string]bool),
+		flushReq: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	if err := db.recover(); err != nil {
+		return nil, err
+	}
+
+	// recover只处理了崩溃遗留下来的旧WAL分段；正常运行期间的新写入还需要
+	// 一个全新的分段来承接。
+	db.walSegNum++
+	db.walPath = walSegmentPath(db.dir, db.walSegNum)
+	w, err := openWAL(db.walPath, db.opts.FsyncOnCommit)
+	if err != nil {
+		return nil, err
+	}
+	db.wal = w
+
+	db.wg.Add(1)
+	go db.flushLoop()
+	return db, nil
+}
+
+// recover discovers existing SSTables on disk, then replays every leftover
+// WAL segment (oldest first) into a single memtable. Under normal shutdown
+// there are no leftover segments - rotateMemtableLocked's segment is only
+// ever left behind by a crash between a memtable rotation and the flush
+// that would have deleted its segment. Anything recovered this way is
+// immediately queued for flush so those old segments get cleaned up
+// instead of being replayed again on every future restart.
+// recover先发现磁盘上已有的SSTable，然后把遗留的WAL分段(按从旧到新的顺序)
+// 重放进同一个memtable。正常关闭的情况下不会有遗留分段——只有在memtable
+// 轮换和本应删除其分段的那次flush之间发生崩溃，分段才会被遗留下来。这样
+// 恢复出来的数据会立刻排队flush，好让这些旧分段被清理掉，而不是在每次
+// 重启时都重放一遍。
+func (db *LSMDatabase) recover() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	var walPaths []string
+	var walNums []uint64
+	for _, e := range entries {
+		// 目录里同时混着.sst和.wal文件，按文件名区分出是SSTable还是WAL分段。
+		if level, fileNum, ok := parseSSTableName(e.Name()); ok {
+			path := filepath.Join(db.dir, e.Name())
+			t, err := loadSSTable(path, level, fileNum)
+			if err != nil {
+				return err
+			}
+			db.levels[level] = append(db.levels[level], t)
+			if fileNum >= db.nextFileNum {
+				db.nextFileNum = fileNum + 1
+			}
+			continue
+		}
+		if num, ok := parseWALSegmentName(e.Name()); ok {
+			walPaths = append(walPaths, filepath.Join(db.dir, e.Name()))
+			walNums = append(walNums, num)
+		}
+	}
+	for lvl := range db.levels {
+		sort.Slice(db.levels[lvl], func(i, j int) bool {
+			return db.levels[lvl][i].fileNum < db.levels[lvl][j].fileNum
+		})
+	}
+	// WAL分段必须按编号从旧到新重放，否则同一个key的先后顺序会乱。
+	order := make([]int, len(walPaths))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return walNums[order[i]] < walNums[order[j]] })
+	sortedPaths := make([]string, len(order))
+	for i, k := range order {
+		sortedPaths[i] = walPaths[k]
+	}
+	walPaths = sortedPaths
+	for _, num := range walNums {
+		if num >= db.walSegNum {
+			db.walSegNum = num
+		}
+	}
+
+	recovered := newMemtable()
+	for _, path := range walPaths {
+		if err := replayWAL(path, func(key, value []byte, del bool) {
+			recovered.put(string(key), common.CopyBytes(value), del)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(walPaths) > 0 {
+		// 把恢复出来的数据立刻排队flush，这样遗留的WAL分段很快就能被删除，
+		// 不会一直占着磁盘、也不会在下次重启时又被重放一遍。
+		db.imm = append(db.imm, immEntry{mt: recovered, walPaths: walPaths})
+		select {
+		case db.flushReq <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// parseSSTableName从sstablePath生成的文件名里解析出level和fileNum，Recover时用。
+func parseSSTableName(name string) (level int, fileNum uint64, ok bool) {
+	if !strings.HasSuffix(name, ".sst") {
+		return 0, 0, false
+	}
+	base := strings.TrimSuffix(name, ".sst")
+	parts := strings.SplitN(base, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	l, err := strconv.Atoi(parts[0])
+	if err != nil || l < 0 || l >= lsmMaxLevels {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return l, n, true
+}
+
+// Put先把写入追加到WAL使其持久化，再应用到活跃memtable，最后检查是否需要
+// 轮换memtable——顺序反过来会丢失"崩溃后WAL里一定有数据"的durability保证。
+func (db *LSMDatabase) Put(key, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.wal.append([]walRecordKV{{key: key, value: value}}); err != nil {
+		return err
+	}
+	db.mem.put(string(key), common.CopyBytes(value), false)
+	return db.maybeRotateMemtableLocked()
+}
+
+// Delete写入一个删除墓碑，同样先落WAL再应用到memtable。
+func (db *LSMDatabase) Delete(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.wal.append([]walRecordKV{{key: key, del: true}}); err != nil {
+		return err
+	}
+	db.mem.put(string(key), nil, true)
+	return db.maybeRotateMemtableLocked()
+}
+
+// Get依次查活跃memtable、不可变memtable(从新到旧)、再逐层查SSTable(同一层内
+// 从新到旧)，第一个命中的即为答案。
+func (db *LSMDatabase) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if e, ok := db.mem.get(string(key)); ok {
+		return resolveMemtableEntry(e)
+	}
+	for i := len(db.imm) - 1; i >= 0; i-- {
+		if e, ok := db.imm[i].mt.get(string(key)); ok {
+			return resolveMemtableEntry(e)
+		}
+	}
+	for lvl := 0; lvl < lsmMaxLevels; lvl++ {
+		tables := db.levels[lvl]
+		for i := len(tables) - 1; i >= 0; i-- {
+			if value, del, ok := tables[i].get(string(key)); ok {
+				atomic.AddUint64(&db.stats.BytesRead, uint64(len(value)))
+				if del {
+					return nil, errNotFound
+				}
+				return common.CopyBytes(value), nil
+			}
+		}
+	}
+	return nil, errNotFound
+}
+
+// resolveMemtableEntry把memtable里找到的节点转换成Get的返回值，墓碑转换成errNotFound。
+func resolveMemtableEntry(e *memtableEntry) ([]byte, error) {
+	if e.del {
+		return nil, errNotFound
+	}
+	return common.CopyBytes(e.value), nil
+}
+
+func (db *LSMDatabase) Has(key []byte) (bool, error) {
+	_, err := db.Get(key)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Close请求flushLoop退出(它会先flush完所有排队的memtable)，等它结束之后
+// 再关闭当前的WAL文件。
+func (db *LSMDatabase) Close() {
+	close(db.closed)
+	db.wg.Wait()
+	db.wal.close()
+}
+
+func (db *LSMDatabase) NewBatch() Batch {
+	return &lsmBatch{db: db}
+}
+
+// Stats returns a snapshot of the database's write/read/space
+// amplification counters.
+// Stats返回数据库写/读/空间放大计数器的一份快照。
+func (db *LSMDatabase) Stats() LSMStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := db.stats
+	s.LiveSSTableSize = 0
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			for _, e := range t.entries {
+				s.LiveSSTableSize += uint64(len(e.key) + len(e.value))
+			}
+		}
+	}
+	return s
+}
+
+// maybeRotateMemtableLocked rotates the active memtable into the
+// immutable queue once it crosses the configured size budget, and wakes
+// the flush goroutine. Callers must hold db.mu.
+// maybeRotateMemtableLocked在活跃memtable超过配置的容量上限时把它轮换进
+// 不可变队列，并唤醒flush goroutine。调用方必须持有db.mu。
+func (db *LSMDatabase) maybeRotateMemtableLocked() error {
+	if db.mem.size < db.opts.MemtableSize {
+		return nil
+	}
+	return db.rotateMemtableLocked()
+}
+
+// rotateMemtableLocked unconditionally retires the active memtable to the
+// immutable queue and starts a fresh one on a brand new WAL segment,
+// waking the flush goroutine. The outgoing memtable is tagged with the WAL
+// segment it was writing through, so once it is flushed that segment's
+// file can be deleted instead of being replayed forever on every Recover.
+// Once a memtable is in db.imm, nothing ever mutates it again - put only
+// ever touches db.mem - so it is safe for a Snapshot to read without
+// holding db.mu. Callers must hold db.mu.
+// rotateMemtableLocked无条件地把活跃memtable退役进不可变队列，并在一个
+// 全新的WAL分段上开始一个新的memtable，然后唤醒flush goroutine。被换出去的
+// memtable会被打上它当初写入所用的WAL分段标记，这样等它被flush之后，那个
+// 分段文件就可以删除，而不用在每次Recover时永远重放下去。一个memtable一旦
+// 进了db.imm就再也不会被修改——put只会碰db.mem——所以Snapshot可以不持有
+// db.mu就安全地读它。调用方必须持有db.mu。
+func (db *LSMDatabase) rotateMemtableLocked() error {
+	db.walSegNum++
+	newPath := walSegmentPath(db.dir, db.walSegNum)
+	newWAL, err := openWAL(newPath, db.opts.FsyncOnCommit)
+	if err != nil {
+		db.walSegNum-- //打开失败，把分段号回滚，避免留下空洞
+		return err
+	}
+
+	db.imm = append(db.imm, immEntry{mt: db.mem, walPaths: []string{db.walPath}})
+	db.mem = newMemtable()
+	db.wal, db.walPath = newWAL, newPath
+
+	select {
+	case db.flushReq <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// lsmBatch implements Batch on top of an LSMDatabase. Write() group-commits
+// every buffered entry as a single WAL record under one lock acquisition,
+// then applies them all to the active memtable, satisfying the "one
+// fsync per batch" contract.
+// lsmBatch在LSMDatabase之上实现了Batch接口。Write()在一次锁内把缓冲的所有
+// entry打包成一条WAL记录group-commit，然后再把它们全部应用到活跃memtable，
+// 满足"每个batch只fsync一次"的约定。
+type lsmBatch struct {
+	db     *LSMDatabase
+	writes []walRecordKV
+	size   int
+}
+
+func (b *lsmBatch) Put(key, value []byte) error {
+	b.writes = append(b.writes, walRecordKV{key: common.CopyBytes(key), value: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *lsmBatch) Delete(key []byte) error {
+	b.writes = append(b.writes, walRecordKV{key: common.CopyBytes(key), del: true})
+	b.size++
+	return nil
+}
+
+func (b *lsmBatch) Write() error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+	if err := b.db.wal.append(b.writes); err != nil {
+		return err
+	}
+	for _, w := range b.writes {
+		b.db.mem.put(string(w.key), w.value, w.del)
+	}
+	return b.db.maybeRotateMemtableLocked()
+}
+
+func (b *lsmBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *lsmBatch) Reset() {
+	b.writes = b.writes[:0]
+	b.size = 0
+}
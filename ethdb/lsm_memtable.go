@@ -0,0 +1,141 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"math/rand"
+)
+
+// memtableMaxLevel bounds how tall the skiplist towers can grow. 16 levels
+// comfortably covers memtables well past the default 64 MiB cap.
+// memtableMaxLevel限制跳表塔的最大高度，16层足够覆盖远超默认64MiB上限的memtable。
+const memtableMaxLevel = 16
+
+// memtableP是每向上一层的概率，0.25是跳表的常见取值。
+const memtableP = 0.25
+
+// memtableEntry is a single key/value slot in the skiplist. A nil value
+// with del set represents a tombstone for key, which must still shadow
+// the same key in older, already-flushed SSTables.
+// memtableEntry是跳表中的一个key/value节点。value为nil且del为true表示一个
+// 墓碑(tombstone)，它仍然必须能遮盖住更早、已经flush到磁盘的SSTable里同名的key。
+type memtableEntry struct {
+	key   string
+	value []byte
+	del   bool            //是否是删除标记
+	next  []*memtableEntry //每一层指向的下一个节点，next[0]就是普通单链表
+}
+
+// memtable is an in-memory skiplist ordered by key. It is the active,
+// mutable write target of an LSMDatabase; once it reaches its size budget
+// it is rotated out to become an immutable memtable awaiting flush to an
+// SSTable. memtable is not safe for concurrent use on its own - callers
+// (LSMDatabase) serialize mutation with their own lock, matching the
+// pattern MemDatabase uses for its map.
+// memtable是一个按key排序的内存跳表，是LSMDatabase当前活跃的、可写的目标；一旦
+// 达到大小上限就会被轮换出去，变成一个等待flush到SSTable的不可变memtable。
+// memtable自身不是并发安全的——调用方(LSMDatabase)用自己的锁来串行化写入，
+// 这和MemDatabase用锁保护它的map是同一个套路。
+type memtable struct {
+	head  *memtableEntry //哨兵头节点，不存真实数据
+	level int            //当前跳表实际用到的最高层数
+	size  int            // approximate bytes of key+value data held, used against the size cap 近似估算的key+value总字节数，用来和容量上限比较
+	rnd   *rand.Rand
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &memtableEntry{next: make([]*memtableEntry, memtableMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(0xC0FFEE)),
+	}
+}
+
+// randomLevel按照memtableP的概率抛硬币，决定新插入节点要占据几层。
+func (m *memtable) randomLevel() int {
+	lvl := 1
+	for lvl < memtableMaxLevel && m.rnd.Float64() < memtableP {
+		lvl++
+	}
+	return lvl
+}
+
+// find locates the predecessor chain for key: update[i] is the rightmost
+// node at level i whose key is strictly less than key.
+// find定位key的前驱链：update[i]是第i层上key严格小于目标key的最靠右的节点，
+// 这是跳表插入/查找的标准做法。
+func (m *memtable) find(key string) (update [memtableMaxLevel]*memtableEntry, found *memtableEntry) {
+	cur := m.head
+	for i := m.level - 1; i >= 0; i-- { //从最高层往下走
+		for cur.next[i] != nil && cur.next[i].key < key {
+			cur = cur.next[i]
+		}
+		update[i] = cur
+	}
+	if next := cur.next[0]; next != nil && next.key == key {
+		found = next
+	}
+	return update, found
+}
+
+// put inserts or overwrites key with value. del marks a tombstone.
+// put插入或者覆盖key对应的value，del为true表示写入一个删除墓碑。
+func (m *memtable) put(key string, value []byte, del bool) {
+	update, found := m.find(key)
+	if found != nil {
+		// 已经存在同名key的节点，直接原地覆盖，不需要改变跳表的链接结构。
+		m.size += len(value) - len(found.value)
+		found.value = value
+		found.del = del
+		return
+	}
+	lvl := m.randomLevel()
+	if lvl > m.level {
+		// 新节点比当前跳表更高，高出来的那些层在头节点这里接上。
+		for i := m.level; i < lvl; i++ {
+			update[i] = m.head
+		}
+		m.level = lvl
+	}
+	entry := &memtableEntry{key: key, value: value, del: del, next: make([]*memtableEntry, lvl)}
+	for i := 0; i < lvl; i++ {
+		entry.next[i] = update[i].next[i]
+		update[i].next[i] = entry
+	}
+	m.size += len(key) + len(value)
+}
+
+// get returns the entry for key, if present (including tombstones - the
+// caller is responsible for interpreting del).
+// get返回key对应的节点(如果存在)，包括墓碑节点——由调用方自己判断del字段。
+func (m *memtable) get(key string) (*memtableEntry, bool) {
+	_, found := m.find(key)
+	if found == nil {
+		return nil, false
+	}
+	return found, true
+}
+
+// ascend calls fn for every entry, tombstones included, in ascending key
+// order.
+// ascend按key从小到大的顺序，对每一个节点调用fn，用于flush时把整个memtable
+// 导出成有序的entry序列。
+func (m *memtable) ascend(fn func(key string, value []byte, del bool)) {
+	for cur := m.head.next[0]; cur != nil; cur = cur.next[0] {
+		fn(cur.key, cur.value, cur.del)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// sstableEntry is one sorted record as it sits on disk: a key, and either a
+// value or a tombstone marker so deletes survive a flush and correctly
+// shadow the same key in older (lower-numbered) SSTables during Get.
+// sstableEntry是磁盘上一条有序记录：一个key，加上一个value或者一个删除墓碑，
+// 这样delete操作在flush之后依然存在，并且能在Get时正确遮盖更早(编号更小)的
+// SSTable里的同名key。
+type sstableEntry struct {
+	key   string
+	value []byte
+	del   bool //是否是删除标记
+}
+
+// sstable is a handle to an immutable, sorted on-disk table. level and
+// number together give it a stable identity for compaction bookkeeping;
+// fileNum is monotonically increasing across the whole database so newer
+// tables (even within the same level) are easy to prefer on overlap.
+// sstable是一个不可变、已排序的磁盘表的句柄。level和fileNum合起来构成它在
+// compaction记账时的稳定身份；fileNum在整个数据库范围内单调递增，所以即使
+// 在同一层内，更新的表也容易判断谁该优先。
+type sstable struct {
+	path    string
+	level   int
+	fileNum uint64
+	entries []sstableEntry // loaded fully for lookup simplicity; real LSMs would use a block index instead 为了查找简单这里全量加载进内存；真正的LSM实现会用块索引代替
+}
+
+// sstablePath按level和fileNum拼出该表在磁盘上的文件名。
+func sstablePath(dir string, level int, fileNum uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%02d-%010d.sst", level, fileNum))
+}
+
+// writeSSTable flushes entries (already sorted by key, as produced by
+// memtable.ascend) to a new sorted-table file on disk.
+// writeSSTable把已经按key排序好的entries(由memtable.ascend产生)写成磁盘上
+// 的一个新的sorted table文件。
+func writeSSTable(path string, entries []sstableEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var lenBuf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) error {
+		n := binary.PutUvarint(lenBuf[:], v)
+		_, err := w.Write(lenBuf[:n])
+		return err
+	}
+	for _, e := range entries {
+		if err := writeUvarint(uint64(len(e.key))); err != nil {
+			return err
+		}
+		if _, err := w.WriteString(e.key); err != nil {
+			return err
+		}
+		if e.del {
+			if _, err := w.Write([]byte{1}); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+		if err := writeUvarint(uint64(len(e.value))); err != nil {
+			return err
+		}
+		if _, err := w.Write(e.value); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// loadSSTable reads an entire table back into memory. Entries on disk are
+// already sorted by construction (writeSSTable only ever receives sorted
+// input), so no re-sort is needed here.
+// loadSSTable把一整张表重新读进内存。磁盘上的entries本来就是有序的(因为
+// writeSSTable只接受已排序的输入)，所以这里不需要重新排序。
+func loadSSTable(path string, level int, fileNum uint64) (*sstable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var entries []sstableEntry
+	for {
+		klen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, err
+		}
+		marker, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if marker == 1 {
+			entries = append(entries, sstableEntry{key: string(key), del: true})
+			continue
+		}
+		vlen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, vlen)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, sstableEntry{key: string(key), value: value})
+	}
+	return &sstable{path: path, level: level, fileNum: fileNum, entries: entries}, nil
+}
+
+// get performs a binary search for key since entries are sorted.
+// get对entries做二分查找，因为entries是有序的。
+func (t *sstable) get(key string) (value []byte, del bool, ok bool) {
+	i := sort.Search(len(t.entries), func(i int) bool { return t.entries[i].key >= key })
+	if i < len(t.entries) && t.entries[i].key == key {
+		e := t.entries[i]
+		return e.value, e.del, true
+	}
+	return nil, false, false
+}
+
+// mergeSorted merges two already-sorted entry slices, preferring newer
+// (the second argument) on key collision. mergeTables uses it to compact
+// overlapping SSTables.
+// mergeSorted合并两个已排序的entry切片，key冲突时以newer(第二个参数)为准。
+// mergeTables用它来compact有重叠的SSTable。
+func mergeSorted(older, newer []sstableEntry) []sstableEntry {
+	merged := make([]sstableEntry, 0, len(older)+len(newer))
+	i, j := 0, 0
+	for i < len(older) && j < len(newer) {
+		switch {
+		case older[i].key < newer[j].key:
+			merged = append(merged, older[i])
+			i++
+		case older[i].key > newer[j].key:
+			merged = append(merged, newer[j])
+			j++
+		default:
+			merged = append(merged, newer[j]) // newer wins on collision key冲突时newer胜出
+			i++
+			j++
+		}
+	}
+	merged = append(merged, older[i:]...)
+	merged = append(merged, newer[j:]...)
+	return merged
+}
@@ -0,0 +1,229 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// walSegmentPath returns the on-disk name for WAL segment num. The WAL is
+// split into one segment per memtable generation (see
+// LSMDatabase.rotateMemtableLocked) rather than a single ever-growing file,
+// so that once a memtable has been durably flushed to an SSTable, the
+// segment(s) that covered its writes can simply be deleted instead of
+// replayed again on every future Recover.
+// walSegmentPath返回WAL分段num对应的磁盘文件名。WAL按memtable的每一代拆分成
+// 独立的分段文件(见LSMDatabase.rotateMemtableLocked)，而不是用一个永远增长的
+// 单一文件，这样一旦某个memtable已经durable地flush到SSTable，覆盖它那部分写入
+// 的分段文件就可以直接删掉，而不用在每次Recover时重放一遍。
+func walSegmentPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%010d.wal", num))
+}
+
+// parseWALSegmentName extracts the segment number from a WAL file name as
+// produced by walSegmentPath, for use during Recover.
+// parseWALSegmentName从walSegmentPath生成的文件名里解析出分段号，Recover时用。
+func parseWALSegmentName(name string) (num uint64, ok bool) {
+	if !strings.HasSuffix(name, ".wal") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// walRecordKV is a single Put or Delete captured inside one WAL record.
+// A Batch.Write() call produces exactly one record containing every kv in
+// the batch, so group-commit only needs a single fsync per batch.
+// walRecordKV是WAL记录里的一条Put或Delete。一次Batch.Write()会产生恰好一条
+// 记录，里面包含该batch的所有kv，这样group-commit每个batch只需要一次fsync。
+type walRecordKV struct {
+	key   []byte
+	value []byte
+	del   bool //是否是删除
+}
+
+// wal is the write-ahead log an LSMDatabase appends to before mutating its
+// active memtable. Every record is length-prefixed and CRC-checked so a
+// torn write at the tail (e.g. after a crash) is detected and discarded
+// during Recover rather than corrupting later records.
+// wal是LSMDatabase在修改活跃memtable之前先追加写入的预写日志。每条记录都带有
+// 长度前缀和CRC校验，这样尾部的半截写入(比如崩溃导致)在Recover时会被发现并
+// 丢弃，而不会污染后面的记录。
+type wal struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	sync bool // fsync after every record 每条记录写完后都fsync
+}
+
+func openWAL(path string, fsyncOnCommit bool) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{file: f, w: bufio.NewWriter(f), sync: fsyncOnCommit}, nil
+}
+
+// append group-commits one framed record containing every kv entry, then
+// optionally fsyncs, all under a single acquisition of l.mu. Its callers
+// (LSMDatabase.Put/Delete and lsmBatch.Write) also hold db.mu across the
+// append and the following memtable update, so concurrent writers are
+// serialized by db.mu.
+// append把entries打包成一条带长度和CRC头的记录，一次性写入并按需fsync；
+// 整个过程只获取一次l.mu。调用方(LSMDatabase.Put/Delete和lsmBatch.Write)
+// 在追加WAL和随后更新memtable的整个过程中还持有db.mu，所以并发的写入方是由
+// db.mu串行化的。
+func (l *wal) append(entries []walRecordKV) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// 先把count和每条kv按varint长度前缀编码进body，体积最小。
+	var body []byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(entries)))
+	body = append(body, lenBuf[:n]...)
+	for _, e := range entries {
+		n = binary.PutUvarint(lenBuf[:], uint64(len(e.key)))
+		body = append(body, lenBuf[:n]...)
+		body = append(body, e.key...)
+		if e.del {
+			body = append(body, 1) //删除标记，后面没有value
+			continue
+		}
+		body = append(body, 0)
+		n = binary.PutUvarint(lenBuf[:], uint64(len(e.value)))
+		body = append(body, lenBuf[:n]...)
+		body = append(body, e.value...)
+	}
+
+	// 头部记录body的长度和CRC32校验值，replayWAL靠这两个字段判断记录是否完整。
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(body))
+	if _, err := l.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := l.w.Write(body); err != nil {
+		return err
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+func (l *wal) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.file.Close()
+}
+
+// replayWAL reads every well-formed record from path in order, calling fn
+// for each kv entry so the caller can repopulate its memtable. A truncated
+// or checksum-mismatched trailing record (the hallmark of a crash mid
+// append) stops replay without returning an error, matching the
+// "best-effort durability up to the last fsync'd record" contract.
+// replayWAL按顺序读取path里每一条完整的记录，对每个kv调用fn，供调用方重建
+// memtable。如果尾部记录被截断或者CRC校验不对(典型的崩溃于追加过程中的场景)，
+// replay会直接停止而不返回错误——这符合"只保证到最后一次成功fsync为止"的
+// 持久化承诺。
+func replayWAL(path string, fn func(key, value []byte, del bool)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break // EOF or short read: end of valid log 读到文件末尾或读取不完整，视为日志正常结束
+		}
+		size := binary.BigEndian.Uint32(hdr[0:4])
+		wantCRC := binary.BigEndian.Uint32(hdr[4:8])
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break // torn trailing record 尾部记录不完整
+		}
+		if crc32.ChecksumIEEE(body) != wantCRC {
+			break // corrupt trailing record 尾部记录CRC校验失败，视为损坏
+		}
+		if err := decodeWALBody(body, fn); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// decodeWALBody解析单条记录的body，依次取出每个kv并调用fn。
+func decodeWALBody(body []byte, fn func(key, value []byte, del bool)) error {
+	buf := body
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return io.ErrUnexpectedEOF
+	}
+	buf = buf[n:]
+	for i := uint64(0); i < count; i++ {
+		klen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < klen {
+			return io.ErrUnexpectedEOF
+		}
+		buf = buf[n:]
+		key := buf[:klen]
+		buf = buf[klen:]
+		if len(buf) < 1 {
+			return io.ErrUnexpectedEOF
+		}
+		del := buf[0] == 1
+		buf = buf[1:]
+		if del {
+			fn(key, nil, true)
+			continue
+		}
+		vlen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < vlen {
+			return io.ErrUnexpectedEOF
+		}
+		buf = buf[n:]
+		value := buf[:vlen]
+		buf = buf[vlen:]
+		fn(key, value, false)
+	}
+	return nil
+}
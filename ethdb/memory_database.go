@@ -29,6 +29,29 @@ import (
 type MemDatabase struct {
 	db   map[string][]byte
 	lock sync.RWMutex					//是读写互斥锁，该锁可以被同时多个读取者持有或唯一个写入者持有。
+
+	// snapRefs计数当前有多少个outstanding的Snapshot/ReadTx。
+	snapRefs int
+
+	// pinnedMapLive is true whenever the map currently held in db.db is
+	// referenced by at least one outstanding Snapshot/ReadTx view (i.e. it
+	// was handed out by Snapshot/ConcurrentReadTx since the last time it was
+	// cloned). cloneForWriteLocked only needs to clone once per such map:
+	// the clone itself is never handed to anyone, so once it exists later
+	// writes can keep mutating it in place - until a new Snapshot/ReadTx
+	// pins it again. Gating purely on snapRefs != 0 instead would reclone
+	// the entire map on every single write for as long as any one pin (e.g.
+	// a long-lived ConcurrentReadTx) stays open, even though only the first
+	// post-pin write actually needs to.
+	// pinnedMapLive表示db.db当前持有的这个map，是否正被至少一个尚未释放的
+	// Snapshot/ReadTx引用着(也就是说自从上一次克隆之后，它被Snapshot/
+	// ConcurrentReadTx发出去过)。cloneForWriteLocked对同一个map只需要克隆一次：
+	// 克隆出来的新map从没发给任何人，所以只要它存在，后续写入就可以一直原地
+	// 修改它——直到有新的Snapshot/ReadTx又把它pin住为止。如果只靠snapRefs
+	// != 0来判断，只要还有一个pin处于存活状态(比如一个长期持有的
+	// ConcurrentReadTx)，就会让之后的每一次写入都重新克隆整个map，而实际上
+	// 只有pin之后的第一次写入才真的需要克隆。
+	pinnedMapLive bool
 }
 
 func NewMemDatabase() *MemDatabase {
@@ -47,10 +70,35 @@ func (db *MemDatabase) Put(key []byte, value []byte) error {
 	db.lock.Lock()					//将db.lock锁定为写入状态，禁止其他线程读取或者写入。
 	defer db.lock.Unlock()			//这条语句在return之后才执行
 
+	db.cloneForWriteLocked()
 	db.db[string(key)] = common.CopyBytes(value)
 	return nil
 }
 
+// cloneForWriteLocked copies db.db into a fresh map before the caller
+// mutates it, but only if the current map is still the one some
+// outstanding Snapshot/ReadTx was handed (pinnedMapLive). Once cloned, the
+// new map is private to this MemDatabase until the next Snapshot/ReadTx
+// pins it, so subsequent writes skip the clone even while old pins (on the
+// now-orphaned previous map) are still outstanding. Callers must hold
+// db.lock for writing.
+// cloneForWriteLocked在调用方要修改db.db之前把它拷贝进一个新map，但前提是
+// 当前这个map确实还是某个存活的Snapshot/ReadTx拿到手里的那一份(pinnedMapLive)。
+// 一旦克隆完成，这个新map在下一次Snapshot/ReadTx把它pin住之前都只属于这个
+// MemDatabase自己，所以即使还有旧的pin存活着(它们引用的是已经被替换掉的旧
+// map)，后续的写入也不需要再克隆。调用方必须已经持有写锁db.lock。
+func (db *MemDatabase) cloneForWriteLocked() {
+	if !db.pinnedMapLive {
+		return
+	}
+	clone := make(map[string][]byte, len(db.db))
+	for k, v := range db.db {
+		clone[k] = v
+	}
+	db.db = clone
+	db.pinnedMapLive = false
+}
+
 //判断数据库中是否存在某个值
 func (db *MemDatabase) Has(key []byte) (bool, error) {
 	db.lock.RLock()			//RLock方法将rw锁定为读取状态，禁止其他线程写入，但不禁止读取。
@@ -87,10 +135,109 @@ func (db *MemDatabase) Delete(key []byte) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	db.cloneForWriteLocked()
 	delete(db.db, string(key))
 	return nil
 }
 
+// Snapshot captures the current db.db map pointer under db.lock, counts it
+// in snapRefs and marks the map as pinned (pinnedMapLive), giving the
+// caller a read view that is unaffected by
+// subsequent Put/Delete calls: those will clone the map rather than
+// mutating the one the snapshot is looking at.
+func (db *MemDatabase) Snapshot() (Snapshot, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.snapRefs++
+	db.pinnedMapLive = true
+	return &memSnapshot{db: db, view: db.db}, nil
+}
+
+type memSnapshot struct {
+	db       *MemDatabase
+	view     map[string][]byte
+	released bool
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	if entry, ok := s.view[string(key)]; ok {
+		return common.CopyBytes(entry), nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *memSnapshot) Has(key []byte) (bool, error) {
+	_, ok := s.view[string(key)]
+	return ok, nil
+}
+
+// Release unpins the snapshot's view. It is safe to call more than once.
+func (s *memSnapshot) Release() {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	s.db.snapRefs--
+	if s.db.snapRefs == 0 {
+		s.db.pinnedMapLive = false
+	}
+}
+
+// ReadTx batches multiple Get/Has calls behind a single lock acquisition:
+// ConcurrentReadTx takes db.lock once (for writing, since it updates the
+// pin state) to capture the current map, after
+// which Get/Has read from that captured view without touching db.lock
+// again, removing the per-call RLock/RUnlock contention MemDatabase.Get
+// normally pays on hot read paths. Like a Snapshot, it pins the map against
+// concurrent writers until Discard is called.
+type ReadTx struct {
+	db       *MemDatabase
+	view     map[string][]byte
+	released bool
+}
+
+// ConcurrentReadTx returns a ReadTx over the database's current contents.
+func (db *MemDatabase) ConcurrentReadTx() *ReadTx {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.snapRefs++
+	db.pinnedMapLive = true
+	return &ReadTx{db: db, view: db.db}
+}
+
+func (tx *ReadTx) Get(key []byte) ([]byte, error) {
+	if entry, ok := tx.view[string(key)]; ok {
+		return common.CopyBytes(entry), nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (tx *ReadTx) Has(key []byte) (bool, error) {
+	_, ok := tx.view[string(key)]
+	return ok, nil
+}
+
+// Discard releases the ReadTx's pin on the database's map. It is safe to
+// call more than once.
+func (tx *ReadTx) Discard() {
+	tx.db.lock.Lock()
+	defer tx.db.lock.Unlock()
+
+	if tx.released {
+		return
+	}
+	tx.released = true
+	tx.db.snapRefs--
+	if tx.db.snapRefs == 0 {
+		tx.db.pinnedMapLive = false
+	}
+}
+
 func (db *MemDatabase) Close() {}
 
 func (db *MemDatabase) NewBatch() Batch {
@@ -128,6 +275,7 @@ func (b *memBatch) Write() error {
 	b.db.lock.Lock()
 	defer b.db.lock.Unlock()
 
+	b.db.cloneForWriteLocked()
 	for _, kv := range b.writes {
 		if kv.del {
 			delete(b.db.db, string(kv.k))
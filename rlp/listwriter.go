@@ -0,0 +1,211 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+// ListWriter emits RLP lists and items incrementally into an io.Writer,
+// without building a single intermediate encbuf for the whole value first.
+// It is intended for hot paths such as trie node hashing, where the caller
+// wants to stream header+content straight into a hash.Hash.
+//
+// Every open list buffers its own content until EndList/Finish, because the
+// RLP length-prefix header must be known and written before the content it
+// describes; there is no way around buffering at least one list's worth of
+// bytes at a time. ListWriter is not safe for concurrent use.
+type ListWriter struct {
+	parent *ListWriter
+	out    io.Writer // only set on the top-level writer returned by NewListWriter
+	buf    bytes.Buffer
+}
+
+var listWriterPool = sync.Pool{
+	New: func() interface{} { return new(ListWriter) },
+}
+
+// NewListWriter returns a ListWriter that streams its eventual output to w
+// once Finish is called. Obtain one from the package pool with
+// NewListWriter and return it with ReturnListWriter to avoid reallocating
+// the internal buffer on hot paths.
+func NewListWriter(w io.Writer) *ListWriter {
+	lw := listWriterPool.Get().(*ListWriter)
+	lw.parent = nil
+	lw.out = w
+	lw.buf.Reset()
+	return lw
+}
+
+// NewHasher is a convenience constructor for the common case of streaming
+// RLP straight into a reusable hash.Hash (e.g. Keccak) instead of building
+// an encoded blob just to hand it to the hash afterwards.
+func NewHasher(h hash.Hash) *ListWriter {
+	return NewListWriter(h)
+}
+
+// ReturnListWriter releases a top-level ListWriter obtained from
+// NewListWriter/NewHasher back to the pool. Calling it on a nested writer
+// returned by BeginList is a mistake and is a no-op.
+func ReturnListWriter(lw *ListWriter) {
+	if lw == nil || lw.parent != nil {
+		return
+	}
+	lw.out = nil
+	listWriterPool.Put(lw)
+}
+
+// WriteString writes s as an RLP string.
+func (w *ListWriter) WriteString(s string) error {
+	return writeRLPString(&w.buf, []byte(s))
+}
+
+// WriteBytes writes b as an RLP string.
+func (w *ListWriter) WriteBytes(b []byte) error {
+	return writeRLPString(&w.buf, b)
+}
+
+// WriteUint writes i as an RLP string containing its minimal big-endian
+// encoding (the empty string for zero), matching the encoding used for
+// Go's uint types elsewhere in this package.
+func (w *ListWriter) WriteUint(i uint64) error {
+	return writeRLPString(&w.buf, uintBytes(i))
+}
+
+// BeginList starts a nested RLP list. sizeHint, if known, pre-grows the
+// nested writer's buffer to avoid reallocation while items are written.
+// The returned writer must be closed with EndList before anything else is
+// written to its parent.
+func (w *ListWriter) BeginList(sizeHint int) *ListWriter {
+	child := listWriterPool.Get().(*ListWriter)
+	child.parent = w
+	child.out = nil
+	child.buf.Reset()
+	if sizeHint > 0 {
+		child.buf.Grow(sizeHint)
+	}
+	return child
+}
+
+// EndList backfills the list header for w's buffered content, appends the
+// result to the parent writer that created it via BeginList, and releases w
+// back to the pool. It is an error to call EndList on the writer returned by
+// NewListWriter/NewHasher; call Finish instead.
+func (w *ListWriter) EndList() error {
+	if w.parent == nil {
+		return errors.New("rlp: EndList called on a top-level ListWriter, use Finish instead")
+	}
+	if err := writeRLPListHeader(&w.parent.buf, w.buf.Len()); err != nil {
+		return err
+	}
+	if _, err := w.parent.buf.Write(w.buf.Bytes()); err != nil {
+		return err
+	}
+	parent := w.parent
+	w.parent = nil
+	listWriterPool.Put(w)
+	_ = parent
+	return nil
+}
+
+// Finish backfills the list header for w's buffered content and writes the
+// complete list (header + content) to the underlying io.Writer passed to
+// NewListWriter/NewHasher. w is released back to the pool; it must not be
+// used afterwards.
+func (w *ListWriter) Finish() error {
+	if w.parent != nil {
+		return errors.New("rlp: Finish called on a nested ListWriter, use EndList instead")
+	}
+	var hdr bytes.Buffer
+	if err := writeRLPListHeader(&hdr, w.buf.Len()); err != nil {
+		return err
+	}
+	if _, err := w.out.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.out.Write(w.buf.Bytes())
+	ReturnListWriter(w)
+	return err
+}
+
+// writeRLPString writes the RLP encoding of b (a string/[]byte value,
+// per the yellow-paper string rules) to dst.
+func writeRLPString(dst *bytes.Buffer, b []byte) error {
+	switch {
+	case len(b) == 1 && b[0] <= 0x7f:
+		dst.WriteByte(b[0])
+	case len(b) <= 55:
+		dst.WriteByte(0x80 + byte(len(b)))
+		dst.Write(b)
+	default:
+		lenOfLen, lenBytes := lengthBytes(uint64(len(b)))
+		dst.WriteByte(0xb7 + lenOfLen)
+		dst.Write(lenBytes)
+		dst.Write(b)
+	}
+	return nil
+}
+
+// writeRLPListHeader writes just the list header (0xC0/0xF7 range) for a
+// list whose already-encoded content is size bytes long.
+func writeRLPListHeader(dst *bytes.Buffer, size int) error {
+	switch {
+	case size <= 55:
+		dst.WriteByte(0xc0 + byte(size))
+	default:
+		lenOfLen, lenBytes := lengthBytes(uint64(size))
+		dst.WriteByte(0xf7 + lenOfLen)
+		dst.Write(lenBytes)
+	}
+	return nil
+}
+
+// lengthBytes returns the minimal big-endian encoding of n together with
+// its length, for use in the long-string/long-list header forms.
+func lengthBytes(n uint64) (lenOfLen byte, b []byte) {
+	b = uintBytes(n)
+	return byte(len(b)), b
+}
+
+// uintBytes returns the minimal big-endian encoding of i, with no leading
+// zero bytes; zero encodes as the empty slice.
+func uintBytes(i uint64) []byte {
+	switch {
+	case i == 0:
+		return nil
+	case i < (1 << 8):
+		return []byte{byte(i)}
+	case i < (1 << 16):
+		return []byte{byte(i >> 8), byte(i)}
+	case i < (1 << 24):
+		return []byte{byte(i >> 16), byte(i >> 8), byte(i)}
+	case i < (1 << 32):
+		return []byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+	case i < (1 << 40):
+		return []byte{byte(i >> 32), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+	case i < (1 << 48):
+		return []byte{byte(i >> 40), byte(i >> 32), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+	case i < (1 << 56):
+		return []byte{byte(i >> 48), byte(i >> 40), byte(i >> 32), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+	default:
+		return []byte{byte(i >> 56), byte(i >> 48), byte(i >> 40), byte(i >> 32), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestListWriterStrings(t *testing.T) {
+	var out bytes.Buffer
+	lw := NewListWriter(&out)
+	lw.WriteString("cat")
+	lw.WriteString("dog")
+	if err := lw.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString("c88363617483646f67")
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestListWriterNested(t *testing.T) {
+	var out bytes.Buffer
+	lw := NewListWriter(&out)
+	lw.WriteUint(1)
+	inner := lw.BeginList(0)
+	inner.WriteUint(2)
+	inner.WriteUint(3)
+	if err := inner.EndList(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lw.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	// [1, [2, 3]]
+	want, _ := hex.DecodeString("c401c20203")
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("got %x, want %x", out.Bytes(), want)
+	}
+}
+
+func TestListWriterEmptyList(t *testing.T) {
+	var out bytes.Buffer
+	lw := NewListWriter(&out)
+	if err := lw.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{0xc0}) {
+		t.Errorf("got %x, want c0", out.Bytes())
+	}
+}
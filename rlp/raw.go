@@ -0,0 +1,222 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// RawValue represents an already rlp-encoded value, e.g. a field a caller
+// wants to re-hash or forward without paying the cost of decoding it into a
+// Go type first and re-encoding it later. Encoding a RawValue writes it to
+// the output unchanged; decoding into a RawValue captures the raw bytes of
+// the next value (including its header) instead of parsing its contents.
+type RawValue []byte
+
+var rawValueType = reflect.TypeOf(RawValue{})
+
+// decodeRawValue captures the complete encoding of the next value on s,
+// header and content both, without interpreting it any further.
+func decodeRawValue(s *Stream, val reflect.Value) error {
+	raw, err := s.Raw()
+	if err != nil {
+		return err
+	}
+	val.SetBytes(raw)
+	return nil
+}
+
+// writeRawValue writes val's bytes to w unchanged; val is assumed to
+// already be valid RLP, as produced by an earlier encode or by Stream.Raw.
+func writeRawValue(val reflect.Value, w *encbuf) error {
+	_, err := w.Write(val.Bytes())
+	return err
+}
+
+// ListIterator walks the elements of an RLP list one at a time, handing
+// back each element as a RawValue without decoding it into a Go type. This
+// is useful for e.g. block headers, where a consumer wants to re-hash or
+// forward a field without paying to decode it.
+//
+// Typical use:
+//
+//	it, err := stream.List()
+//	for it.Next() {
+//		raw := it.Value()
+//	}
+//	err = it.End()
+type ListIterator struct {
+	data []byte
+	cur  RawValue
+	err  error
+}
+
+// NewListIterator returns an iterator over the elements of raw, which must
+// be the complete encoding (header included) of a single RLP list value.
+func NewListIterator(raw RawValue) (*ListIterator, error) {
+	content, err := rawListContent(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &ListIterator{data: content}, nil
+}
+
+// List enters the list at the stream's current position and returns an
+// iterator over its elements, each handed back as a RawValue without being
+// decoded into a Go type.
+func (s *Stream) List() (*ListIterator, error) {
+	raw, err := s.Raw()
+	if err != nil {
+		return nil, err
+	}
+	return NewListIterator(RawValue(raw))
+}
+
+// Next advances the iterator to the next element. It returns false once
+// the list is exhausted or a malformed element is encountered; callers
+// should check Err (or the error returned by End) to tell the two apart.
+func (it *ListIterator) Next() bool {
+	if it.err != nil || len(it.data) == 0 {
+		return false
+	}
+	elem, rest, err := splitRawElement(it.data)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.cur, it.data = RawValue(elem), rest
+	return true
+}
+
+// Value returns the raw, still-encoded bytes of the current element,
+// including its RLP header, so re-encoding it elsewhere is just a memcpy.
+func (it *ListIterator) Value() RawValue {
+	return it.cur
+}
+
+// Err returns the error, if any, that stopped iteration early.
+func (it *ListIterator) Err() error {
+	return it.err
+}
+
+// End finishes iteration, returning a non-nil error if the list content
+// was malformed.
+func (it *ListIterator) End() error {
+	return it.err
+}
+
+// rawListContent strips the list header off raw and returns its content,
+// erroring if raw is not a well-formed RLP list encoding.
+func rawListContent(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	first := raw[0]
+	switch {
+	case first >= 0xc0 && first <= 0xf7:
+		size := int(first - 0xc0)
+		if len(raw) < 1+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return raw[1 : 1+size], nil
+	case first > 0xf7:
+		lenOfLen := int(first - 0xf7)
+		if len(raw) < 1+lenOfLen {
+			return nil, io.ErrUnexpectedEOF
+		}
+		start := 1 + lenOfLen
+		size, err := decodeBigEndianLen(raw[1:start], len(raw)-start)
+		if err != nil {
+			return nil, err
+		}
+		return raw[start : start+size], nil
+	default:
+		return nil, fmt.Errorf("rlp: NewListIterator called on non-list value (first byte 0x%x)", first)
+	}
+}
+
+// splitRawElement peels the next complete RLP-encoded element (single byte,
+// string, or list - header and content included) off the front of b,
+// following the yellow-paper length-prefix rules: a single byte below 0x80
+// is itself; 0x80-0xb7 is a short string of length (first-0x80); 0xb8-0xbf
+// is a long string preceded by a length-of-length; 0xc0-0xf7 is a short
+// list of length (first-0xc0); 0xf8-0xff is a long list preceded by a
+// length-of-length.
+func splitRawElement(b []byte) (element, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	first := b[0]
+	var total int
+	switch {
+	case first < 0x80:
+		total = 1
+	case first <= 0xb7:
+		total = 1 + int(first-0x80)
+	case first <= 0xbf:
+		lenOfLen := int(first - 0xb7)
+		if len(b) < 1+lenOfLen {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		size, err := decodeBigEndianLen(b[1:1+lenOfLen], len(b)-(1+lenOfLen))
+		if err != nil {
+			return nil, nil, err
+		}
+		total = 1 + lenOfLen + size
+	case first <= 0xf7:
+		total = 1 + int(first-0xc0)
+	default:
+		lenOfLen := int(first - 0xf7)
+		if len(b) < 1+lenOfLen {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		size, err := decodeBigEndianLen(b[1:1+lenOfLen], len(b)-(1+lenOfLen))
+		if err != nil {
+			return nil, nil, err
+		}
+		total = 1 + lenOfLen + size
+	}
+	if len(b) < total {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[:total], b[total:], nil
+}
+
+// decodeBigEndianLen decodes a length-of-length byte run as used by the
+// long-string/long-list RLP header forms, and validates the result against
+// avail (the number of bytes actually left in the input after the header).
+// Decoding straight into an int without this check is unsafe: up to 8
+// length bytes are accumulated, and a crafted value with the top bit of the
+// first byte set (e.g. length-of-length 8 starting with 0xff) overflows
+// into a negative int once cast. A negative size then defeats the
+// "len(buf) < start+size"-style bounds checks at the call sites (a very
+// negative number is never greater than a small positive len(buf)), and
+// the subsequent slice expression panics instead of returning an error.
+// Comparing against avail up front catches both the overflow case and any
+// merely-too-large length in one place.
+func decodeBigEndianLen(b []byte, avail int) (int, error) {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	if n > uint64(avail) {
+		return 0, fmt.Errorf("rlp: length-of-length decodes to %d, but only %d bytes remain", n, avail)
+	}
+	return int(n), nil
+}
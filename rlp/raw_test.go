@@ -0,0 +1,48 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import "testing"
+
+// TestNewListIteratorMalformedLongLength checks that a crafted long-list
+// header whose 8-byte length-of-length has the top bit set returns an
+// error instead of decoding to a negative length and panicking on the
+// subsequent slice expression.
+func TestNewListIteratorMalformedLongLength(t *testing.T) {
+	raw := RawValue{0xff, 0xff, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := NewListIterator(raw); err == nil {
+		t.Fatal("expected error for malformed length-of-length, got nil")
+	}
+}
+
+// TestSplitRawElementMalformedLongLength exercises the same overflow via
+// the long-string header form used by splitRawElement.
+func TestSplitRawElementMalformedLongLength(t *testing.T) {
+	b := []byte{0xbf, 0xff, 0, 0, 0, 0, 0, 0, 0}
+	if _, _, err := splitRawElement(b); err == nil {
+		t.Fatal("expected error for malformed length-of-length, got nil")
+	}
+}
+
+func TestSplitRawElementTooLargeButNotOverflowing(t *testing.T) {
+	// length-of-length says the content is 1000 bytes, but only a handful
+	// of bytes are actually present - should error, not panic.
+	b := []byte{0xb9, 0x03, 0xe8, 0x01, 0x02}
+	if _, _, err := splitRawElement(b); err == nil {
+		t.Fatal("expected error for oversized length, got nil")
+	}
+}
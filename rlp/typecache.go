@@ -17,21 +17,42 @@
 package rlp
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// EOL is returned by a field decoder when the input list has no more
+// elements left to decode. decodeStructFields uses it to tell "the list
+// ended here because every remaining field is optional" apart from "the
+// list ended here but a required field was still expected".
+// EOL在输入列表已经没有更多元素可解码时，由字段的解码器返回。decodeStructFields
+// 靠它来区分"列表到这里结束是因为剩下的字段都是optional的"，还是
+// "列表到这里结束了，但还有必填字段没读到"这两种情况。
+var EOL = errors.New("rlp: end of list")
+
 //sync包提供了基本的同步，如互斥锁。除了Once和WaitGroup类型，大部分都是适用于低水平程序线程，高水平的同步使用channel通信更好一些。
 var (
-	//Mutex是一个互斥锁，可以创建为其他结构体的字段
-	typeCacheMutex sync.RWMutex					//读写锁，用来在多线程的时候保护typeCache这个Map
-	//核心数据结构，保存了类型->编解码器函数
-	//map有两种初始化的方式，map[string]string{}或make(map[string]string)
-	typeCache      = make(map[typekey]*typeinfo)			//map[typekey]*typeinfo，相当于map<typekey,*typeinfo>
+	// typeCacheCur持有当前生效的map[typekey]*typeinfo快照，所有读取（编码/解码热路径）都通过
+	// atomic.Value无锁加载这个快照，不再需要在每次查找时加锁。
+	typeCacheCur atomic.Value
+
+	// typeCacheMutex只在cache miss(需要为新类型生成typeinfo)时才会被获取，用来串行化写入者；
+	// 读取者完全不会碰这把锁，从而消除了并发编解码时读写锁带来的锁竞争。
+	typeCacheMutex sync.Mutex
+	// typeCacheGenerating保存正在生成中的类型对应的“占位”typeinfo，由typeCacheMutex保护。
+	// 当生成器在生成某个类型时又递归查到了自身(自引用类型)，会先看到这个占位值而不会无限递归。
+	typeCacheGenerating = make(map[typekey]*typeinfo)
 )
 
+func init() {
+	typeCacheCur.Store(make(map[typekey]*typeinfo))
+}
+
 type typeinfo struct {			//存储了编码器和解码器函数
 	decoder
 	writer
@@ -45,6 +66,17 @@ type tags struct {
 	// elements. It can only be set for the last field, which must be  它只能设置为最后一个字段，这是必须是slice类型
 	// of slice type.
 	tail bool
+	// rlp:"optional" marks a field that may be absent from the input list.  标记此字段在输入列表中可能缺失。
+	// If the list ends before this field during decode, it is left zero-  如果列表在解码到此字段之前就结束了，该字段保持零值
+	// valued instead of producing an error; on encode, a trailing run of  而不是报错；编码时，末尾连续的零值optional字段可以被省略。
+	// zero-valued optional fields may be elided. All optional fields must
+	// be contiguous at the end of the struct, before any tail field.
+	optional bool
+	// rlp:"size=N" requires a []byte or string field to decode to exactly  要求[]byte或string字段解码出的长度必须正好是N字节
+	// N bytes, erroring out otherwise. hasSize distinguishes "size=0" from  否则报错。hasSize用来区分"没有写size标签"和"写了size=0"。
+	// the tag not being present at all.
+	size    int
+	hasSize bool
 	// rlp:"-" ignores fields. 忽略此字段
 	ignored bool
 }
@@ -61,45 +93,59 @@ type decoder func(*Stream, reflect.Value) error
 //定义一个函数，别名叫writer
 type writer func(reflect.Value, *encbuf) error
 
-//获取对应类型的typeinfo(包含编码器和解码器函数)
+//获取对应类型的typeinfo(包含编码器和解码器函数)，读路径完全无锁。
 func cachedTypeInfo(typ reflect.Type, tags tags) (*typeinfo, error) {
-	typeCacheMutex.RLock()			//加读锁来保护，
-	//传入类型到一个map中，然后返回编解码函数
-	info := typeCache[typekey{typ, tags}]			//:=是短变量声明, 定义一个或多个变量并根据它们的初始值为这些变量赋予适当类型
-	typeCacheMutex.RUnlock()
-	//如果成功获取到信息，那么就返回
-	if info != nil {			//nil代表指针、通道、函数、接口、映射或切片的零值
+	//atomic.Load取出当前快照map，直接做一次普通的map查找，不持有任何锁。
+	cur := typeCacheCur.Load().(map[typekey]*typeinfo)
+	if info := cur[typekey{typ, tags}]; info != nil {
 		return info, nil
 	}
 	// not in the cache, need to generate info for this type.
-	//否则加写锁 调用cachedTypeInfo1函数创建并返回， 这里需要注意的是在多线程环境下有可能多个线程同时调用到这个地方，所以当你进入
-	// cachedTypeInfo1方法的时候需要判断一下是否已经被别的线程先创建成功了。
+	//只有cache miss才会走到这里加锁，所以这把锁只会串行化"生成新typeinfo"这件事本身，
+	//不会影响已经在缓存中的类型的并发读取。
 	typeCacheMutex.Lock()
 	defer typeCacheMutex.Unlock()			//这个要等本函数完全执行完之后才执行这行，defer延迟执行
 	return cachedTypeInfo1(typ, tags)
 }
 
-//根据传入的类型，创建并返回对应的typeinfo(包含编码器和解码器函数)
+//根据传入的类型，创建并返回对应的typeinfo(包含编码器和解码器函数)。
+//调用者必须持有typeCacheMutex——既可以是cachedTypeInfo加的锁，也可以是genTypeInfo
+//在生成过程中递归调用structFields时沿用的同一把锁，这样自引用类型的递归查找才是安全的。
 func cachedTypeInfo1(typ reflect.Type, tags tags) (*typeinfo, error) {
 	key := typekey{typ, tags}
-	info := typeCache[key]				//先去map中取该类型对应的value(编解码函数)。info是*typeinfo类型，即typeinfo类型的指针
-	if info != nil {
+	//先在当前生效的快照里查一遍，可能在排队等锁的过程中已经被别的goroutine生成好了。
+	if info := typeCacheCur.Load().(map[typekey]*typeinfo)[key]; info != nil {
 		// another goroutine got the write lock first
 		return info, nil			// 其他的线程可能已经创建成功了， 那么我们直接获取到信息然后返回
 	}
-	// put a dummy value into the cache before generating.
+	//再看看是不是本次生成链路里已经为这个类型放了占位值（自引用类型递归到了自己）。
+	if info := typeCacheGenerating[key]; info != nil {
+		return info, nil
+	}
+	// put a dummy value into the generating map before generating.
 	// if the generator tries to lookup itself, it will get
 	// the dummy value and won't call itself recursively.
-	typeCache[key] = new(typeinfo)
+	info := new(typeinfo)
+	typeCacheGenerating[key] = info
+	defer delete(typeCacheGenerating, key)			//不管成功失败，生成结束后占位值都要清理掉
+
 	//genTypeInfo：生成对应类型的编解码器函数。
-	info, err := genTypeInfo(typ, tags)
-	if err != nil {						//创建失败
-		// remove the dummy value if the generator fails
-		delete(typeCache, key)			//删除map中对应key的键值对
+	generated, err := genTypeInfo(typ, tags)
+	if err != nil { //创建失败
 		return nil, err
 	}
-	*typeCache[key] = *info    //info是指向typeinfo类型的指针，*info把这个typeinfo类型变量取出
-	return typeCache[key], err			//这个err其实位nil
+	*info = *generated //info是指向typeinfo类型的指针，把生成好的内容拷贝进占位的typeinfo里
+
+	//把旧快照整个拷贝一份、加上新entry，再原子地替换掉旧快照，这样正在进行中的无锁读取
+	//要么看到完整的旧map，要么看到完整的新map，不会读到半生成状态。
+	cur := typeCacheCur.Load().(map[typekey]*typeinfo)
+	next := make(map[typekey]*typeinfo, len(cur)+1)
+	for k, v := range cur {
+		next[k] = v
+	}
+	next[key] = info
+	typeCacheCur.Store(next)
+	return info, nil
 }
 
 type field struct {
@@ -107,38 +153,67 @@ type field struct {
 	info  *typeinfo
 }
 
-//structFields函数遍历所有的字段，然后针对每一个字段调用cachedTypeInfo1
-func structFields(typ reflect.Type) (fields []field, err error) {
+//structFields函数遍历所有的字段，然后针对每一个字段调用cachedTypeInfo1。
+//返回的fieldTags和fields一一对应，decodeStructFields/writeStructFields用它来
+//判断每个字段的optional/size标签该怎么处理。
+func structFields(typ reflect.Type) (fields []field, fieldTags []tags, err error) {
 	for i := 0; i < typ.NumField(); i++ {				//NumField返回struct类型的字段计数。
 		if f := typ.Field(i); f.PkgPath == "" { // exported  //f.PkgPath == "" 这个判断针对的是所有导出的字段， 所谓的导出的字段就是说以大写字母开头命令的字段。
 			tags, err := parseStructTag(typ, i)			//parseStructTag解析标签tags
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			if tags.ignored {
 				continue
 			}
 			info, err := cachedTypeInfo1(f.Type, tags)			//针对每一个字段调用cachedTypeInfo1
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			fields = append(fields, field{i, info})
+			fieldTags = append(fieldTags, tags)
 		}
 	}
-	return fields, nil
+	if err := validateOptionalFields(typ, fields, fieldTags); err != nil {
+		return nil, nil, err
+	}
+	return fields, fieldTags, nil
+}
+
+// validateOptionalFields确保所有rlp:"optional"字段都聚在结构体末尾、连续出现
+// (如果有rlp:"tail"字段，则是紧挨在它前面)，这样解码时一旦输入列表提前结束，
+// 剩下还没读到的字段就一定都是optional的，可以安全地保持零值，不会漏掉一个
+// 本应必填的字段。这和上面对"tail"只能出现在最后一个字段的校验是同一类检查。
+func validateOptionalFields(typ reflect.Type, fields []field, fieldTags []tags) error {
+	end := len(fieldTags)
+	if end > 0 && fieldTags[end-1].tail {
+		end--
+	}
+	seenOptional := false
+	for i := 0; i < end; i++ {
+		if fieldTags[i].optional {
+			seenOptional = true
+			continue
+		}
+		if seenOptional {
+			name := typ.Field(fields[i].index).Name
+			return fmt.Errorf(`rlp: optional field %v.%s must not be followed by non-optional fields`, typ, name)
+		}
+	}
+	return nil
 }
 
 func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 	f := typ.Field(fi)
 	var ts tags
 	for _, t := range strings.Split(f.Tag.Get("rlp"), ",") {
-		switch t = strings.TrimSpace(t); t {
-		case "":
-		case "-":
+		switch t = strings.TrimSpace(t); {
+		case t == "":
+		case t == "-":
 			ts.ignored = true
-		case "nil":
+		case t == "nil":
 			ts.nilOK = true
-		case "tail":
+		case t == "tail":
 			ts.tail = true
 			if fi != typ.NumField()-1 {
 				return ts, fmt.Errorf(`rlp: invalid struct tag "tail" for %v.%s (must be on last field)`, typ, f.Name)
@@ -146,6 +221,19 @@ func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 			if f.Type.Kind() != reflect.Slice {
 				return ts, fmt.Errorf(`rlp: invalid struct tag "tail" for %v.%s (field type is not slice)`, typ, f.Name)
 			}
+		case t == "optional":
+			ts.optional = true
+		case strings.HasPrefix(t, "size="):
+			arg := strings.TrimPrefix(t, "size=")
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return ts, fmt.Errorf(`rlp: invalid struct tag "size=%s" for %v.%s (want a non-negative integer)`, arg, typ, f.Name)
+			}
+			isByteSlice := f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Uint8
+			if !isByteSlice && f.Type.Kind() != reflect.String {
+				return ts, fmt.Errorf(`rlp: invalid struct tag "size" for %v.%s (field type is not []byte or string)`, typ, f.Name)
+			}
+			ts.size, ts.hasSize = n, true
 		default:
 			return ts, fmt.Errorf("rlp: unknown struct tag %q on %v.%s", t, typ, f.Name)
 		}
@@ -155,6 +243,30 @@ func parseStructTag(typ reflect.Type, fi int) (tags, error) {
 //生成对应类型的编解码器函数。
 func genTypeInfo(typ reflect.Type, tags tags) (info *typeinfo, err error) {
 	info = new(typeinfo)
+	// rlp.RawValue有专门的编解码方式：编码是原样写出、解码是原样截取对应的子RLP，
+	// 不需要也不应该走常规的makeDecoder/makeWriter反射生成路径。
+	if typ == rawValueType {
+		info.decoder = decodeRawValue
+		info.writer = writeRawValue
+		return info, nil
+	}
+	// struct类型的字段需要单独处理optional/size标签(省略末尾的optional字段、
+	// 校验size标签的字节数)，这些逻辑是按字段而不是按单个值的kind决定的，所以
+	// 放在makeDecoder/makeWriter的通用kind分发之外单独生成，而不是指望它们
+	// 内部去读tags.optional/tags.size。
+	if typ.Kind() == reflect.Struct {
+		fields, fieldTags, err := structFields(typ)
+		if err != nil {
+			return nil, err
+		}
+		info.decoder = func(s *Stream, v reflect.Value) error {
+			return decodeStructFields(s, v, fields, fieldTags)
+		}
+		info.writer = func(v reflect.Value, w *encbuf) error {
+			return writeStructFields(w, v, fields, fieldTags)
+		}
+		return info, nil
+	}
 	//info.decoder, err = makeDecoder(typ, tags)是赋值，不是布尔表达式
 	if info.decoder, err = makeDecoder(typ, tags); err != nil {		//创建解码器
 		return nil, err				//创建失败的返回值
@@ -166,6 +278,74 @@ func genTypeInfo(typ reflect.Type, tags tags) (info *typeinfo, err error) {
 	return info, nil
 }
 
+// decodeStructFields decodes fields (as produced by structFields) from s in
+// declaration order. If the input list runs out before a field tagged
+// rlp:"optional" is reached, that field and every field after it are left
+// at their zero value instead of producing an error - validateOptionalFields
+// already guarantees every field from here on is optional too (apart from a
+// final rlp:"tail" field, which is then left empty), so it is safe to stop
+// as soon as the first one is. A field tagged rlp:"size=N"
+// must decode to exactly N bytes, or decoding fails.
+// decodeStructFields按声明顺序依次从s解码fields(由structFields生成)。如果
+// 输入列表在解码到某个rlp:"optional"字段之前就用完了，这个字段以及它之后的
+// 所有字段都会保持零值，而不是报错——validateOptionalFields已经保证了从这
+// 里开始往后的字段肯定都是optional的(最后一个rlp:"tail"字段除外，它此时保持
+// 为空)，所以一旦遇到第一个就可以安全地停下来。
+// 标了rlp:"size=N"的字段解码出来的字节数必须正好是N，否则解码失败。
+func decodeStructFields(s *Stream, v reflect.Value, fields []field, fieldTags []tags) error {
+	for i, f := range fields {
+		fv := v.Field(f.index)
+		err := f.info.decoder(s, fv)
+		if err == EOL {
+			if !fieldTags[i].optional {
+				return fmt.Errorf("rlp: too few elements for %v.%s", v.Type(), v.Type().Field(f.index).Name)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if fieldTags[i].hasSize {
+			if n := fv.Len(); n != fieldTags[i].size {
+				return fmt.Errorf(`rlp: field %v.%s decoded to %d bytes, want %d (rlp:"size=%d")`,
+					v.Type(), v.Type().Field(f.index).Name, n, fieldTags[i].size, fieldTags[i].size)
+			}
+		}
+	}
+	return nil
+}
+
+// writeStructFields writes fields (as produced by structFields) to w in
+// declaration order. A trailing run of zero-valued fields tagged
+// rlp:"optional" is omitted from the output entirely, so appending a new
+// optional field to a struct does not change the encoding of values that
+// never set it. rlp:"size=N" is a decode-time constraint only (see
+// decodeStructFields) - encoding never rejects a field for having the
+// "wrong" length, since a caller may legitimately want to encode and later
+// reject, rather than be blocked from encoding, a malformed value.
+// writeStructFields按声明顺序把fields(由structFields生成)依次写入w。末尾
+// 一段连续为零值的rlp:"optional"字段会被整段省略掉，所以给struct追加一个新
+// 的optional字段不会改变那些从没用过它的值的编码结果。rlp:"size=N"只是一个
+// 解码时的约束(见decodeStructFields)——编码阶段不会因为字段长度"不对"就拒绝
+// 写入，因为调用方可能就是想先编码、之后再拒绝一个畸形的值，而不是在编码这
+// 一步就被卡住。
+func writeStructFields(w *encbuf, v reflect.Value, fields []field, fieldTags []tags) error {
+	lastNonZero := -1
+	for i, f := range fields {
+		if fieldTags[i].optional && v.Field(f.index).IsZero() {
+			continue // 暂时先跳过，等确定了整个末尾零值段的长度之后统一处理
+		}
+		lastNonZero = i
+	}
+	for i := 0; i <= lastNonZero; i++ {
+		fv := v.Field(fields[i].index)
+		if err := fields[i].info.writer(fv, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func isUint(k reflect.Kind) bool {
 	return k >= reflect.Uint && k <= reflect.Uintptr
 }
@@ -0,0 +1,105 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type optionalTailStruct struct {
+	Required uint64
+	A        uint64 `rlp:"optional"`
+	B        string `rlp:"optional"`
+}
+
+type invalidOptionalStruct struct {
+	A uint64 `rlp:"optional"`
+	B uint64
+}
+
+type sizedStruct struct {
+	Hash [32]byte
+	Addr []byte `rlp:"size=20"`
+}
+
+func TestOptionalFieldsRoundTrip(t *testing.T) {
+	in := optionalTailStruct{Required: 1, A: 2, B: "hi"}
+	enc, err := EncodeToBytes(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out optionalTailStruct
+	if err := DecodeBytes(enc, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+}
+
+func TestOptionalFieldMissingFromInput(t *testing.T) {
+	// Encode only the Required field, as if produced by an older encoder
+	// that predates the optional trailing fields.
+	enc, err := EncodeToBytes([]interface{}{uint64(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out optionalTailStruct
+	if err := DecodeBytes(enc, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := optionalTailStruct{Required: 7}
+	if out != want {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+}
+
+func TestInvalidOptionalPlacement(t *testing.T) {
+	_, _, err := structFields(reflect.TypeOf(invalidOptionalStruct{}))
+	if err == nil {
+		t.Fatal("expected error for non-contiguous optional field, got nil")
+	}
+}
+
+func TestSizeTagRoundTrip(t *testing.T) {
+	in := sizedStruct{Addr: bytes.Repeat([]byte{0x11}, 20)}
+	enc, err := EncodeToBytes(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out sizedStruct
+	if err := DecodeBytes(enc, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Addr, in.Addr) {
+		t.Errorf("got %x, want %x", out.Addr, in.Addr)
+	}
+}
+
+func TestSizeTagViolation(t *testing.T) {
+	in := sizedStruct{Addr: bytes.Repeat([]byte{0x11}, 19)} // one byte short
+	enc, err := EncodeToBytes(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out sizedStruct
+	if err := DecodeBytes(enc, &out); err == nil {
+		t.Fatal("expected size mismatch error, got nil")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rlp
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// benchNested的嵌套字段用来撑开typeinfo的生成成本，确保benchmark真正在压测
+// cachedTypeInfo的并发读路径，而不是单纯测Encode本身。
+type benchNestedInner struct {
+	A uint64
+	B []byte
+	C string
+}
+
+type benchNestedOuter struct {
+	Inner benchNestedInner
+	List  []benchNestedInner
+	Tail  []uint64 `rlp:"tail"`
+}
+
+// BenchmarkEncodeConcurrentInterface每个CPU起一个goroutine，并发对同一个嵌套
+// struct做Encode，用来验证typeCache改为atomic.Value之后，无锁读路径确实能
+// 随CPU数量线性扩展，而不是像RWMutex那样在RLock上出现争用。
+func BenchmarkEncodeConcurrentInterface(b *testing.B) {
+	value := benchNestedOuter{
+		Inner: benchNestedInner{A: 1, B: []byte("hello"), C: "world"},
+		List: []benchNestedInner{
+			{A: 2, B: []byte("foo"), C: "bar"},
+			{A: 3, B: []byte("baz"), C: "quux"},
+		},
+		Tail: []uint64{1, 2, 3},
+	}
+
+	ncpu := runtime.NumCPU()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(ncpu)
+		for g := 0; g < ncpu; g++ {
+			go func() {
+				defer wg.Done()
+				if _, err := EncodeToBytes(value); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}